@@ -0,0 +1,137 @@
+package goka
+
+import "time"
+
+const (
+	defaultBatchSize   = 1
+	defaultBatchLinger = 0
+)
+
+// processorOptions collects the tunables a Processor is constructed with.
+// They are assembled from the ProcessorOption values passed to NewProcessor
+// and threaded down into each partition.
+type processorOptions struct {
+	rebalanceCb RebalanceCallback
+
+	batchProcess batchProcessCallback
+	batchSize    int
+	batchLinger  time.Duration
+
+	stallPeriod      time.Duration
+	stalledTimeout   time.Duration
+	onStall          StallCallback
+	onStallRecovered StallRecoveredCallback
+
+	checkpointInterval time.Duration
+	checkpointEveryN   int
+}
+
+func newProcessorOptions(opts ...ProcessorOption) *processorOptions {
+	o := &processorOptions{
+		batchSize:   defaultBatchSize,
+		batchLinger: defaultBatchLinger,
+
+		stallPeriod:    defaultStallPeriod,
+		stalledTimeout: defaultStalledTimeout,
+
+		checkpointInterval: defaultCheckpointInterval,
+		checkpointEveryN:   defaultCheckpointEveryN,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// ProcessorOption configures optional behavior of a Processor.
+type ProcessorOption func(*processorOptions)
+
+// WithRebalanceCallback registers the callback invoked whenever a partition
+// is assigned, finishes recovery, or is revoked. See RebalanceCallback for
+// the goroutine guarantee and the event types for their ordering.
+func WithRebalanceCallback(cb RebalanceCallback) ProcessorOption {
+	return func(o *processorOptions) {
+		o.rebalanceCb = cb
+	}
+}
+
+// WithBatchProcess switches a processor's partitions from the default
+// per-message process callback to a batched one, coalescing up to
+// BatchSize messages (or every BatchLinger, whichever comes first) into a
+// single call.
+func WithBatchProcess(cb batchProcessCallback) ProcessorOption {
+	return func(o *processorOptions) {
+		o.batchProcess = cb
+	}
+}
+
+// WithBatchSize configures the maximum number of messages a batched process
+// callback is handed at once. It has no effect on a processor that was not
+// given a batch process callback.
+func WithBatchSize(size int) ProcessorOption {
+	return func(o *processorOptions) {
+		o.batchSize = size
+	}
+}
+
+// WithBatchLinger bounds how long a partition waits to fill a batch before
+// flushing a partial one to the batch process callback. A zero duration
+// disables the linger: a batch is then flushed once BatchSize messages have
+// accumulated, or as a partial batch on EOF and when the partition stops.
+func WithBatchLinger(d time.Duration) ProcessorOption {
+	return func(o *processorOptions) {
+		o.batchLinger = d
+	}
+}
+
+// WithRecoveryStallPeriod configures how often a partition checks whether
+// its recovery has stalled. Defaults to 30s.
+func WithRecoveryStallPeriod(d time.Duration) ProcessorOption {
+	return func(o *processorOptions) {
+		o.stallPeriod = d
+	}
+}
+
+// WithRecoveryStallTimeout configures how long a partition may go without
+// seeing a message during recovery before it is reported as stalled.
+// Defaults to 2m.
+func WithRecoveryStallTimeout(d time.Duration) ProcessorOption {
+	return func(o *processorOptions) {
+		o.stalledTimeout = d
+	}
+}
+
+// WithOnStall registers a callback fired when a partition's recovery has
+// not seen a message for longer than the configured stall timeout.
+func WithOnStall(cb StallCallback) ProcessorOption {
+	return func(o *processorOptions) {
+		o.onStall = cb
+	}
+}
+
+// WithOnStallRecovered registers a callback fired once messages resume
+// flowing for a partition that was previously reported as stalled.
+func WithOnStallRecovered(cb StallRecoveredCallback) ProcessorOption {
+	return func(o *processorOptions) {
+		o.onStallRecovered = cb
+	}
+}
+
+// WithRecoveryOffsetCheckpoint configures how often a partition persists
+// its recovered offset to local storage: every interval, or every n
+// messages, whichever comes first. It also checkpoints unconditionally at
+// EOF, once recovery completes, and when the partition is stopped.
+//
+// This trades write amplification for a wider replay window on an unclean
+// shutdown: goka's recovery is idempotent (replaying from the last stored
+// offset re-applies updates that were already written to storage), so
+// correctness only depends on the offset never being persisted ahead of
+// the Update calls it accounts for - which is exactly what the buffering
+// in partition.load guarantees. The default, everyN=1, matches the
+// historical behavior of persisting the offset on every message.
+func WithRecoveryOffsetCheckpoint(interval time.Duration, everyN int) ProcessorOption {
+	return func(o *processorOptions) {
+		o.checkpointInterval = interval
+		o.checkpointEveryN = everyN
+	}
+}
@@ -1,6 +1,8 @@
 package goka
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -14,31 +16,71 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 )
 
+// ErrStopTimeout is returned by stopWithContext when the passed context is
+// done before the partition finished shutting down. The partition keeps
+// shutting down in the background; callers only learn that the wait itself
+// was cut short, not that the partition failed to stop.
+var ErrStopTimeout = errors.New("goka: partition did not stop before context was done")
+
 const (
 	defaultPartitionChannelSize = 10
-	stallPeriod                 = 30 * time.Second
-	stalledTimeout              = 2 * time.Minute
+	defaultStallPeriod          = 30 * time.Second
+	defaultStalledTimeout       = 2 * time.Minute
+
+	// defaultCheckpointEveryN persists the offset after every recovered
+	// message, matching goka's historical (pre-checkpointing) behavior.
+	defaultCheckpointEveryN   = 1
+	defaultCheckpointInterval = 0
 )
 
+// StallCallback is invoked when a partition's recovery has not seen a
+// message for longer than the configured stall timeout.
+type StallCallback func(topic string, partition int32, sinceLastMessage time.Duration)
+
+// StallRecoveredCallback is invoked once messages resume flowing for a
+// partition that was previously reported as stalled.
+type StallRecoveredCallback func(topic string, partition int32)
+
 type partition struct {
-	log   logger.Logger
-	topic string
+	log       logger.Logger
+	topic     string
+	partition int32
 
 	ch      chan kafka.Event
-	st      *storageProxy
+	st      recoveryStorage
 	proxy   kafkaProxy
 	process processCallback
 
-	dying    chan bool
+	batchProcess batchProcessCallback
+	batchSize    int
+	batchLinger  time.Duration
+
+	stallPeriod      time.Duration
+	stalledTimeout   time.Duration
+	onStall          StallCallback
+	onStallRecovered StallRecoveredCallback
+
+	checkpointInterval time.Duration
+	checkpointEveryN   int
+
 	done     chan bool
 	stopFlag int64
 
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	recoveredFlag int32
 	hwm           int64
 	offset        int64
+	stalledFlag   int32
+
+	lastMessageMu sync.RWMutex
+	lastMessageAt time.Time
 
 	recoveredOnce sync.Once
 
+	rebalanceCb RebalanceCallback
+
 	stats *partitionStats
 }
 
@@ -51,28 +93,109 @@ type kafkaProxy interface {
 
 type processCallback func(msg *message, st storage.Storage, wg *sync.WaitGroup, pstats *partitionStats) (int, error)
 
-func newPartition(log logger.Logger, topic string, cb processCallback, st *storageProxy, proxy kafkaProxy, reg metrics.Registry, channelSize int) *partition {
+// batchProcessCallback processes a batch of messages at once and returns
+// the number of updates applied across the whole batch, allowing a handler
+// to amortize per-message overhead (e.g. DB round-trips) across BatchSize
+// messages instead of paying it on every single one.
+type batchProcessCallback func(msgs []*message, st storage.Storage, wg *sync.WaitGroup, pstats *partitionStats) (int, error)
+
+func newPartition(log logger.Logger, topic string, part int32, cb processCallback, st recoveryStorage, proxy kafkaProxy, reg metrics.Registry, channelSize int, rebalanceCb RebalanceCallback) *partition {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &partition{
-		log:   log,
-		topic: topic,
+		log:       log,
+		topic:     topic,
+		partition: part,
+
+		ch:   make(chan kafka.Event, channelSize),
+		done: make(chan bool),
 
-		ch:    make(chan kafka.Event, channelSize),
-		dying: make(chan bool),
-		done:  make(chan bool),
+		ctx:    ctx,
+		cancel: cancel,
 
 		st:            st,
 		recoveredOnce: sync.Once{},
 		proxy:         proxy,
 		process:       cb,
 
+		batchSize:   defaultBatchSize,
+		batchLinger: defaultBatchLinger,
+
+		stallPeriod:    defaultStallPeriod,
+		stalledTimeout: defaultStalledTimeout,
+
+		checkpointInterval: defaultCheckpointInterval,
+		checkpointEveryN:   defaultCheckpointEveryN,
+
+		rebalanceCb: rebalanceCb,
+
 		stats: newStats(),
 	}
 }
 
+// withBatchProcess switches the partition to use a batched process callback
+// instead of the per-message one, flushing batches of up to batchSize
+// messages or every batchLinger, whichever comes first.
+func (p *partition) withBatchProcess(cb batchProcessCallback, batchSize int, batchLinger time.Duration) *partition {
+	p.batchProcess = cb
+	if batchSize > 0 {
+		p.batchSize = batchSize
+	}
+	p.batchLinger = batchLinger
+	return p
+}
+
+// withStallDetection overrides the default stall period/timeout and
+// registers the callbacks fired when recovery stalls and resumes.
+func (p *partition) withStallDetection(period, timeout time.Duration, onStall StallCallback, onStallRecovered StallRecoveredCallback) *partition {
+	if period > 0 {
+		p.stallPeriod = period
+	}
+	if timeout > 0 {
+		p.stalledTimeout = timeout
+	}
+	p.onStall = onStall
+	p.onStallRecovered = onStallRecovered
+	return p
+}
+
+// withRecoveryCheckpoint overrides how often load persists the recovered
+// offset to local storage: every interval, or every n messages, whichever
+// comes first. A zero interval disables the time-based trigger.
+func (p *partition) withRecoveryCheckpoint(interval time.Duration, everyN int) *partition {
+	p.checkpointInterval = interval
+	if everyN > 0 {
+		p.checkpointEveryN = everyN
+	}
+	return p
+}
+
+// notifyRebalance calls the processor's RebalanceCallback, if any, with the
+// given event. It is a no-op when no callback was configured.
+func (p *partition) notifyRebalance(ev RebalanceEvent) {
+	if p.rebalanceCb != nil {
+		p.rebalanceCb(ev)
+	}
+}
+
+// notifyRevoked emits PartitionRevoked once recover/run (or catchup) has
+// returned. Calling it from start/startCatchup, rather than from
+// stopWithContext, keeps it on the partition's own goroutine alongside
+// PartitionAssigned/PartitionRecovered, so a RebalanceCallback never sees
+// Revoked racing an in-progress Recovered.
+func (p *partition) notifyRevoked() {
+	p.notifyRebalance(PartitionRevoked{Topic: p.topic, Partition: p.partition, Offset: atomic.LoadInt64(&p.offset)})
+}
+
 func (p *partition) start() error {
 	defer close(p.done)
 	defer p.proxy.Stop()
+	defer p.notifyRevoked()
 
+	// PartitionAssigned always precedes PartitionRevoked, even for a
+	// stateless partition (LocalOffset is then meaningless and left at 0)
+	// so a RebalanceCallback can pair them up without special-casing.
+	var local int64
 	if !p.st.Stateless() {
 		err := p.st.Open()
 		if err != nil {
@@ -80,6 +203,14 @@ func (p *partition) start() error {
 		}
 		defer p.st.Close()
 
+		local, err = p.st.GetOffset(sarama.OffsetOldest)
+		if err != nil {
+			return fmt.Errorf("error reading local offset: %v", err)
+		}
+	}
+	p.notifyRebalance(PartitionAssigned{Topic: p.topic, Partition: p.partition, LocalOffset: local})
+
+	if !p.st.Stateless() {
 		if err := p.recover(); err != nil {
 			return err
 		}
@@ -95,6 +226,7 @@ func (p *partition) start() error {
 func (p *partition) startCatchup() error {
 	defer close(p.done)
 	defer p.proxy.Stop()
+	defer p.notifyRevoked()
 
 	err := p.st.Open()
 	if err != nil {
@@ -102,14 +234,50 @@ func (p *partition) startCatchup() error {
 	}
 	defer p.st.Close()
 
+	local, err := p.st.GetOffset(sarama.OffsetOldest)
+	if err != nil {
+		return fmt.Errorf("error reading local offset: %v", err)
+	}
+	p.notifyRebalance(PartitionAssigned{Topic: p.topic, Partition: p.partition, LocalOffset: local})
+	defer p.notifyRevoked()
+
 	return p.catchup()
 }
 
 func (p *partition) stop() {
+	// context.Background() is never done, so this preserves the original,
+	// unbounded blocking behavior.
+	_ = p.stopWithContext(context.Background())
+}
+
+// stopWithContext stops the partition, giving run/load a chance to drain
+// their in-flight message and commit the current offset before exiting.
+// It waits for that to finish until ctx is done, at which point it returns
+// ErrStopTimeout so the caller can distinguish a clean shutdown from a
+// forced one; the partition keeps shutting down in the background.
+func (p *partition) stopWithContext(ctx context.Context) error {
 	atomic.StoreInt64(&p.stopFlag, 1)
-	close(p.dying)
-	<-p.done
-	close(p.ch)
+	// cancelling p.ctx is the only shutdown signal run/load observe; it
+	// drives them through the drain-and-commit path below and, once they
+	// return, notifyRevoked fires from their own goroutine.
+	p.cancel()
+
+	select {
+	case <-p.done:
+		close(p.ch)
+		return nil
+	case <-ctx.Done():
+		return ErrStopTimeout
+	}
+}
+
+// commitOffset persists the partition's current in-memory offset to local
+// storage, so a graceful stop doesn't lose an already-applied update.
+func (p *partition) commitOffset() error {
+	if p.st.Stateless() {
+		return nil
+	}
+	return p.st.SetOffset(atomic.LoadInt64(&p.offset))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -127,6 +295,13 @@ func newMessage(ev *kafka.Message) *message {
 }
 
 func (p *partition) run() error {
+	if p.batchProcess != nil {
+		return p.runBatch()
+	}
+	return p.runSingle()
+}
+
+func (p *partition) runSingle() error {
 	var wg sync.WaitGroup
 	p.proxy.AddGroup()
 	defer wg.Wait()
@@ -148,8 +323,9 @@ func (p *partition) run() error {
 				if err != nil {
 					return fmt.Errorf("error processing message: %v", err)
 				}
-				p.offset += int64(updates)
-				p.hwm = p.offset + 1
+				offset := atomic.AddInt64(&p.offset, int64(updates))
+				atomic.StoreInt64(&p.hwm, offset+1)
+				p.setLastMessageAt(time.Now())
 
 				// metrics
 				p.stats.Input.Count[ev.Topic]++
@@ -168,10 +344,121 @@ func (p *partition) run() error {
 				return fmt.Errorf("load: cannot handle %T = %v", ev, ev)
 			}
 
-		case <-p.dying:
+		case <-p.ctx.Done():
+			return p.commitOffset()
+		}
+
+	}
+}
+
+// runBatch is the batched counterpart of runSingle: it coalesces reads from
+// p.ch into a slice bounded by batchSize/batchLinger, invokes batchProcess
+// once per batch, and only then advances offset/hwm. A partial batch is
+// still flushed on EOF and when the partition is stopped, so a shutdown
+// never loses acknowledged work.
+func (p *partition) runBatch() error {
+	var wg sync.WaitGroup
+	p.proxy.AddGroup()
+	defer wg.Wait()
+
+	batch := make([]*message, 0, p.batchSize)
+
+	// linger is reset to batchLinger when the first message of a new batch
+	// arrives, so the deadline is measured from that message rather than
+	// free-running, and stopped/drained again whenever a batch is flushed.
+	var linger *time.Timer
+	var lingerC <-chan time.Time
+	if p.batchLinger > 0 {
+		linger = time.NewTimer(p.batchLinger)
+		if !linger.Stop() {
+			<-linger.C
+		}
+		defer linger.Stop()
+		lingerC = linger.C
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
 			return nil
 		}
+		if linger != nil && !linger.Stop() {
+			select {
+			case <-linger.C:
+			default:
+			}
+		}
+
+		// batchProcess is handed a *sync.WaitGroup, i.e. it may hand the
+		// batch off to something that outlives this call, so it must not
+		// share a backing array with the next batch.
+		toProcess := batch
+		batch = make([]*message, 0, p.batchSize)
+
+		updates, err := p.batchProcess(toProcess, p.st, &wg, p.stats)
+		if err != nil {
+			return fmt.Errorf("error processing batch: %v", err)
+		}
+		offset := atomic.AddInt64(&p.offset, int64(updates))
+		atomic.StoreInt64(&p.hwm, offset+1)
+		p.setLastMessageAt(time.Now())
+		return nil
+	}
+
+	for {
+		select {
+		case ev, isOpen := <-p.ch:
+			// channel already closed, ev will be nil
+			if !isOpen {
+				return flush()
+			}
+			switch ev := ev.(type) {
+			case *kafka.Message:
+				if ev.Topic == p.topic {
+					return fmt.Errorf("received message from group table topic after recovery")
+				}
 
+				if linger != nil && len(batch) == 0 {
+					linger.Reset(p.batchLinger)
+				}
+				batch = append(batch, newMessage(ev))
+
+				// metrics
+				p.stats.Input.Count[ev.Topic]++
+				p.stats.Input.Bytes[ev.Topic] += len(ev.Value)
+				if !ev.Timestamp.IsZero() {
+					p.stats.Input.Delay[ev.Topic] = time.Since(ev.Timestamp)
+				}
+
+				if len(batch) >= p.batchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+
+			case *kafka.NOP:
+				// don't do anything but also don't log.
+			case *kafka.EOF:
+				if ev.Topic != p.topic {
+					return fmt.Errorf("received EOF of topic that is not ours. This should not happend (ours=%s, received=%s)", p.topic, ev.Topic)
+				}
+				if err := flush(); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("load: cannot handle %T = %v", ev, ev)
+			}
+
+		case <-lingerC:
+			if err := flush(); err != nil {
+				return err
+			}
+
+		case <-p.ctx.Done():
+			if err := flush(); err != nil {
+				return err
+			}
+			return p.commitOffset()
+		}
 	}
 }
 
@@ -191,6 +478,69 @@ func (p *partition) recovered() bool {
 	return atomic.LoadInt32(&p.recoveredFlag) == 1
 }
 
+// setStalled updates both the stats snapshot (for log/debug output, only
+// ever touched from the partition's own goroutine) and stalledFlag, the
+// atomic mirror that currentStat reads so it stays race-free under `go
+// test -race` when called concurrently with run/load.
+func (p *partition) setStalled(stalled bool) {
+	p.stats.Table.Stalled = stalled
+	if stalled {
+		atomic.StoreInt32(&p.stalledFlag, 1)
+	} else {
+		atomic.StoreInt32(&p.stalledFlag, 0)
+	}
+}
+
+func (p *partition) isStalled() bool {
+	return atomic.LoadInt32(&p.stalledFlag) == 1
+}
+
+func (p *partition) setLastMessageAt(t time.Time) {
+	p.lastMessageMu.Lock()
+	p.lastMessageAt = t
+	p.lastMessageMu.Unlock()
+}
+
+func (p *partition) getLastMessageAt() time.Time {
+	p.lastMessageMu.RLock()
+	defer p.lastMessageMu.RUnlock()
+	return p.lastMessageAt
+}
+
+// PartitionStat is a point-in-time snapshot of a partition's recovery and
+// processing state. It is safe to read concurrently with run/load.
+type PartitionStat struct {
+	Offset        int64
+	HWM           int64
+	Lag           int64
+	Recovered     bool
+	Stalled       bool
+	LastMessageAt time.Time
+}
+
+// currentStat takes an atomic snapshot of the partition's offset,
+// high-water-mark and lag, so it can be read safely while run/load are
+// concurrently advancing them. Processor.Stats() calls this for every
+// partition it owns.
+func (p *partition) currentStat() PartitionStat {
+	offset := atomic.LoadInt64(&p.offset)
+	hwm := atomic.LoadInt64(&p.hwm)
+
+	lag := hwm - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+
+	return PartitionStat{
+		Offset:        offset,
+		HWM:           hwm,
+		Lag:           lag,
+		Recovered:     p.recovered(),
+		Stalled:       p.isStalled(),
+		LastMessageAt: p.getLastMessageAt(),
+	}
+}
+
 func (p *partition) load(catchup bool) error {
 	// fetch local offset
 	local, err := p.st.GetOffset(sarama.OffsetOldest)
@@ -200,9 +550,29 @@ func (p *partition) load(catchup bool) error {
 	p.proxy.Add(p.topic, local)
 	defer p.proxy.Remove(p.topic)
 
-	stallTicker := time.NewTicker(stallPeriod)
+	stallTicker := time.NewTicker(p.stallPeriod)
 	defer stallTicker.Stop()
 
+	var checkpointC <-chan time.Time
+	if p.checkpointInterval > 0 {
+		checkpointTicker := time.NewTicker(p.checkpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointC = checkpointTicker.C
+	}
+
+	pending := make([]*kafka.Message, 0, p.recoveryBatchSize())
+
+	flushPending := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := p.storeEvents(pending); err != nil {
+			return err
+		}
+		pending = pending[:0]
+		return nil
+	}
+
 	var lastMessage time.Time
 	for {
 		select {
@@ -215,7 +585,7 @@ func (p *partition) load(catchup bool) error {
 
 			switch ev := ev.(type) {
 			case *kafka.BOF:
-				p.hwm = ev.Hwm
+				atomic.StoreInt64(&p.hwm, ev.Hwm)
 
 				if ev.Offset == ev.Hwm {
 					// nothing to recover
@@ -225,8 +595,11 @@ func (p *partition) load(catchup bool) error {
 				}
 
 			case *kafka.EOF:
-				p.offset = ev.Hwm - 1
-				p.hwm = ev.Hwm
+				if err := flushPending(); err != nil {
+					return fmt.Errorf("load: error updating storage: %v", err)
+				}
+				atomic.StoreInt64(&p.offset, ev.Hwm-1)
+				atomic.StoreInt64(&p.hwm, ev.Hwm)
 
 				if err := p.markRecovered(); err != nil {
 					return fmt.Errorf("error setting recovered: %v", err)
@@ -239,15 +612,22 @@ func (p *partition) load(catchup bool) error {
 
 			case *kafka.Message:
 				lastMessage = time.Now()
+				p.setLastMessageAt(lastMessage)
 				if ev.Topic != p.topic {
 					return fmt.Errorf("load: wrong topic = %s", ev.Topic)
 				}
-				err := p.storeEvent(ev)
-				if err != nil {
-					return fmt.Errorf("load: error updating storage: %v", err)
+				pending = append(pending, ev)
+				if len(pending) >= p.recoveryBatchSize() {
+					if err := flushPending(); err != nil {
+						return fmt.Errorf("load: error updating storage: %v", err)
+					}
 				}
-				p.offset = ev.Offset
-				if p.offset >= p.hwm-1 {
+				atomic.StoreInt64(&p.offset, ev.Offset)
+				hwm := atomic.LoadInt64(&p.hwm)
+				if ev.Offset >= hwm-1 {
+					if err := flushPending(); err != nil {
+						return fmt.Errorf("load: error updating storage: %v", err)
+					}
 					if err := p.markRecovered(); err != nil {
 						return fmt.Errorf("error setting recovered: %v", err)
 					}
@@ -259,8 +639,11 @@ func (p *partition) load(catchup bool) error {
 				if !ev.Timestamp.IsZero() {
 					p.stats.Input.Delay[ev.Topic] = time.Since(ev.Timestamp)
 				}
-				if ev.Offset < p.hwm-1 {
-					p.stats.Table.Stalled = false
+				if ev.Offset < hwm-1 && p.isStalled() {
+					p.setStalled(false)
+					if p.onStallRecovered != nil {
+						p.onStallRecovered(p.topic, p.partition)
+					}
 				}
 
 			case *kafka.NOP:
@@ -270,26 +653,90 @@ func (p *partition) load(catchup bool) error {
 				return fmt.Errorf("load: cannot handle %T = %v", ev, ev)
 			}
 
+		case <-checkpointC:
+			// time-based half of WithRecoveryOffsetCheckpoint: flush
+			// whatever was buffered even if we haven't hit checkpointEveryN
+			// yet, so a cold start on a slow topic still checkpoints.
+			if err := flushPending(); err != nil {
+				return fmt.Errorf("load: error updating storage: %v", err)
+			}
+
 		case now := <-stallTicker.C:
+			// flush whatever was buffered so far; no point holding
+			// acknowledged updates in memory while we look stalled
+			if err := flushPending(); err != nil {
+				return fmt.Errorf("load: error updating storage: %v", err)
+			}
 			// only set to stalled, if the last message was earlier
 			// than the stalled timeout
-			if now.Sub(lastMessage) > stalledTimeout {
-				p.stats.Table.Stalled = true
+			if sinceLastMessage := now.Sub(lastMessage); sinceLastMessage > p.stalledTimeout {
+				p.setStalled(true)
+				if p.onStall != nil {
+					p.onStall(p.topic, p.partition, sinceLastMessage)
+				}
 			}
 
-		case <-p.dying:
+		case <-p.ctx.Done():
+			if err := flushPending(); err != nil {
+				return fmt.Errorf("load: error updating storage: %v", err)
+			}
+			if err := p.commitOffset(); err != nil {
+				return fmt.Errorf("load: error committing offset: %v", err)
+			}
 			return nil
 		}
 	}
 }
 
-func (p *partition) storeEvent(msg *kafka.Message) error {
-	err := p.st.Update(msg.Key, msg.Value)
-	if err != nil {
-		return fmt.Errorf("Error from the update callback while recovering from the log: %v", err)
+// recoveryBatchSize returns how many messages load buffers before
+// persisting their updates and offset to local storage, i.e. the
+// count-based half of WithRecoveryOffsetCheckpoint.
+func (p *partition) recoveryBatchSize() int {
+	if p.checkpointEveryN > 0 {
+		return p.checkpointEveryN
 	}
-	err = p.st.SetOffset(int64(msg.Offset))
-	if err != nil {
+	return 1
+}
+
+// storeUpdater is the subset of *storageProxy that storeEventsInto needs.
+// Splitting it out lets the recovery write path be exercised by a test
+// double, without a live storage backend.
+type storeUpdater interface {
+	Update(key string, value []byte) error
+	SetOffset(value int64) error
+}
+
+// recoveryStorage is the subset of *storageProxy that partition needs for
+// recovery and normal operation. Depending on this interface, rather than
+// *storageProxy directly, lets load be driven end-to-end by a test double
+// too, the same way storeUpdater does for storeEventsInto alone.
+type recoveryStorage interface {
+	storeUpdater
+	Open() error
+	Close() error
+	Stateless() bool
+	GetOffset(defaultValue int64) (int64, error)
+	MarkRecovered() error
+}
+
+// storeEvents applies a batch of messages to local storage and persists
+// the offset once, for the last message in the batch. Goka's recovery is
+// idempotent (replay from the last stored offset re-applies updates that
+// were already in storage), so correctness is preserved as long as the
+// offset is only advanced after the corresponding Update calls have been
+// flushed, which is what this function guarantees.
+func (p *partition) storeEvents(msgs []*kafka.Message) error {
+	return storeEventsInto(p.st, msgs)
+}
+
+func storeEventsInto(st storeUpdater, msgs []*kafka.Message) error {
+	for _, msg := range msgs {
+		if err := st.Update(msg.Key, msg.Value); err != nil {
+			return fmt.Errorf("Error from the update callback while recovering from the log: %v", err)
+		}
+	}
+	last := msgs[len(msgs)-1]
+	if err := st.SetOffset(int64(last.Offset)); err != nil {
 		return fmt.Errorf("Error updating offset in local storage while recovering from the log: %v", err)
 	}
 	return nil
@@ -301,6 +748,9 @@ func (p *partition) markRecovered() (err error) {
 	p.recoveredOnce.Do(func() {
 		atomic.StoreInt32(&p.recoveredFlag, 1)
 		err = p.st.MarkRecovered()
+		if err == nil {
+			p.notifyRebalance(PartitionRecovered{Topic: p.topic, Partition: p.partition, Hwm: atomic.LoadInt64(&p.hwm)})
+		}
 	})
 	return
 }
@@ -0,0 +1,95 @@
+package goka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lovoo/goka/logger"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Processor owns one *partition per Kafka partition of a single group table
+// topic. It is the entry point that assembles
+// the ProcessorOptions and hands them down into newPartition, and the place
+// that exposes the per-partition primitives (stats, graceful stop) as a
+// first-class API.
+type Processor struct {
+	log   logger.Logger
+	topic string
+
+	partitions map[int32]*partition
+}
+
+// NewProcessor builds a Processor over partitionIDs, constructing one
+// *partition per id via partitionOf, which returns that partition's
+// storage and Kafka proxies.
+func NewProcessor(log logger.Logger, topic string, partitionIDs []int32, cb processCallback, partitionOf func(id int32) (recoveryStorage, kafkaProxy), reg metrics.Registry, channelSize int, opts ...ProcessorOption) *Processor {
+	o := newProcessorOptions(opts...)
+
+	partitions := make(map[int32]*partition, len(partitionIDs))
+	for _, id := range partitionIDs {
+		st, proxy := partitionOf(id)
+		p := newPartition(log, topic, id, cb, st, proxy, reg, channelSize, o.rebalanceCb)
+		if o.batchProcess != nil {
+			p.withBatchProcess(o.batchProcess, o.batchSize, o.batchLinger)
+		}
+		p.withStallDetection(o.stallPeriod, o.stalledTimeout, o.onStall, o.onStallRecovered)
+		p.withRecoveryCheckpoint(o.checkpointInterval, o.checkpointEveryN)
+		partitions[id] = p
+	}
+
+	return &Processor{
+		log:        log,
+		topic:      topic,
+		partitions: partitions,
+	}
+}
+
+// Stats returns a point-in-time snapshot of every partition this processor
+// owns, keyed by topic then partition id. It is safe to call concurrently
+// with the partitions' run/load loops, and is meant to drive Prometheus
+// exporters and readiness checks.
+func (g *Processor) Stats() map[string]map[int32]PartitionStat {
+	stats := make(map[int32]PartitionStat, len(g.partitions))
+	for id, p := range g.partitions {
+		stats[id] = p.currentStat()
+	}
+	return map[string]map[int32]PartitionStat{g.topic: stats}
+}
+
+// HighWaterMarks returns the last known high-water-mark of every partition
+// this processor owns, keyed by partition id.
+func (g *Processor) HighWaterMarks() map[int32]int64 {
+	hwms := make(map[int32]int64, len(g.partitions))
+	for id, p := range g.partitions {
+		hwms[id] = p.currentStat().HWM
+	}
+	return hwms
+}
+
+// Stop gracefully stops every partition this processor owns, giving each
+// until ctx is done to drain its in-flight message and commit its offset.
+// It waits for all of them and returns the first ErrStopTimeout seen, if
+// any, so a caller can distinguish a clean shutdown from a forced one.
+func (g *Processor) Stop(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(g.partitions))
+	for _, p := range g.partitions {
+		wg.Add(1)
+		go func(p *partition) {
+			defer wg.Done()
+			errs <- p.stopWithContext(ctx)
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+
+	var first error
+	for err := range errs {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,44 @@
+package goka
+
+// RebalanceEvent is implemented by all events passed to a RebalanceCallback.
+type RebalanceEvent interface {
+	isRebalanceEvent()
+}
+
+// PartitionAssigned is emitted right before a partition starts (re-)loading
+// its state, i.e. before any recovery or processing happens.
+type PartitionAssigned struct {
+	Topic       string
+	Partition   int32
+	LocalOffset int64
+}
+
+func (PartitionAssigned) isRebalanceEvent() {}
+
+// PartitionRecovered is emitted once a partition has finished recovering its
+// table, i.e. the local storage caught up with the table's high-water-mark.
+type PartitionRecovered struct {
+	Topic     string
+	Partition int32
+	Hwm       int64
+}
+
+func (PartitionRecovered) isRebalanceEvent() {}
+
+// PartitionRevoked is emitted once a partition's recover/run loop has
+// returned, either because the group rebalanced it away or because the
+// processor is shutting down. It fires after any in-flight message has
+// been drained and the offset committed, from the same goroutine as
+// PartitionAssigned/PartitionRecovered.
+type PartitionRevoked struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+func (PartitionRevoked) isRebalanceEvent() {}
+
+// RebalanceCallback is invoked whenever a partition is assigned, finishes
+// recovery, or is revoked. It is called synchronously from the partition's
+// goroutine, so it must not block for long or it will delay processing.
+type RebalanceCallback func(RebalanceEvent)